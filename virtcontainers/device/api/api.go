@@ -0,0 +1,41 @@
+// Copyright (c) 2018 Huawei Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package api
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/kata-containers/runtime/virtcontainers/device/config"
+)
+
+// Device is implemented by every passthrough device driver in
+// virtcontainers/device/drivers.
+type Device interface {
+	Attach(devReceiver DeviceReceiver) error
+	Detach(devReceiver DeviceReceiver) error
+	IsAttached() bool
+	DeviceType() config.DeviceType
+	DeviceID() string
+	GetDeviceInfo() interface{}
+}
+
+// DeviceReceiver is implemented by whatever hotplugs a Device into the
+// running sandbox (the sandbox/hypervisor layer).
+type DeviceReceiver interface {
+	HotplugAddDevice(dev Device, devType config.DeviceType) error
+	HotplugRemoveDevice(dev Device, devType config.DeviceType) error
+	// HotplugUpdateDevice notifies devType's dev appeared (added = true)
+	// or disappeared (added = false) on the host after it was already
+	// attached, eg a USB device plugged in or removed after sandbox
+	// start.
+	HotplugUpdateDevice(dev interface{}, devType config.DeviceType, added bool) error
+}
+
+// DeviceLogger returns the logger used by the device api package and its
+// callers.
+func DeviceLogger() *logrus.Entry {
+	return logrus.WithField("subsystem", "device-api")
+}
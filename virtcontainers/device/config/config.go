@@ -0,0 +1,54 @@
+// Copyright (c) 2018 Huawei Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package config
+
+// DeviceType identifies the kind of device a driver in
+// virtcontainers/device/drivers knows how to attach to a sandbox.
+type DeviceType string
+
+const (
+	// DeviceVFIO is a VFIO passthrough device (pci, vmbus, vdpa).
+	DeviceVFIO DeviceType = "vfio"
+	// DeviceUSB is a USB passthrough device.
+	DeviceUSB DeviceType = "usb"
+)
+
+// SysIOMMUPath is the sysfs directory IOMMU groups are enumerated under.
+const SysIOMMUPath = "/sys/kernel/iommu_groups"
+
+// DeviceInfo carries the host-side identity of a device to be passed
+// through to a sandbox, along with whether it's currently hotplugged.
+type DeviceInfo struct {
+	ID         string
+	HostPath   string
+	Hotplugged bool
+}
+
+// VFIODev describes one device within a VFIO IOMMU group, as surfaced to
+// the hypervisor layer.
+type VFIODev struct {
+	ID  string
+	BDF string
+	// Bus is the host bus the device lives on (pci, vmbus, vdpa).
+	Bus string
+	// GuestDevName is a best-effort name (eg "vda") resolved from a uevent
+	// observed on the host after hotplug; it is not reported by the guest
+	// and may stay empty (see pkg/uevent's package doc for why).
+	GuestDevName string
+	// VendorName and DeviceName are the human-readable pci.ids names for
+	// the device's vendor/device ids, when known.
+	VendorName string
+	DeviceName string
+}
+
+// USBDev describes a USB device passed through to a sandbox, as surfaced
+// to the hypervisor layer.
+type USBDev struct {
+	VendorID  string
+	ProductID string
+	Bus       string
+	Device    string
+}
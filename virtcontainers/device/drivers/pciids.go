@@ -0,0 +1,173 @@
+// Copyright (c) 2018 Huawei Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package drivers
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+//go:embed data/pci.ids
+var embeddedPCIIDs []byte
+
+// pciIDSearchPaths are searched, in order, for a system-provided pci.ids
+// database before falling back to the embedded copy.
+var pciIDSearchPaths = []string{
+	"/usr/share/hwdata/pci.ids",
+	"/usr/share/misc/pci.ids",
+}
+
+// pciVendorEntry is a single vendor record from pci.ids, along with its
+// known devices.
+type pciVendorEntry struct {
+	Name    string
+	Devices map[string]string // device id (lowercase hex) -> device name
+}
+
+// pciIDDatabase is a parsed pci.ids file, keyed by lowercase hex vendor id.
+type pciIDDatabase struct {
+	Vendors map[string]*pciVendorEntry
+}
+
+var (
+	pciIDs     *pciIDDatabase
+	pciIDsOnce sync.Once
+)
+
+// getPCIIDs returns the parsed pci.ids database, loading it from the host
+// (or the embedded fallback) on first use.
+func getPCIIDs() *pciIDDatabase {
+	pciIDsOnce.Do(func() {
+		pciIDs = parsePCIIDs(loadPCIIDsData())
+	})
+	return pciIDs
+}
+
+// loadPCIIDsData reads the first pci.ids file found under
+// pciIDSearchPaths, falling back to the copy embedded in the binary.
+func loadPCIIDsData() []byte {
+	for _, path := range pciIDSearchPaths {
+		if data, err := os.ReadFile(path); err == nil {
+			return data
+		}
+	}
+	return embeddedPCIIDs
+}
+
+// parsePCIIDs parses the pci.ids format: vendor lines start in column
+// zero ("8086  Intel Corporation"), device lines are indented with a
+// single tab ("\t10fb  82599ES ..."), and subsystem lines (indented with
+// two tabs) are skipped, since only vendor/device names are needed here.
+func parsePCIIDs(data []byte) *pciIDDatabase {
+	db := &pciIDDatabase{Vendors: make(map[string]*pciVendorEntry)}
+
+	var current *pciVendorEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "\t\t") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "\t") {
+			if current == nil {
+				continue
+			}
+			id, name, ok := splitIDLine(strings.TrimPrefix(line, "\t"))
+			if ok {
+				current.Devices[id] = name
+			}
+			continue
+		}
+
+		id, name, ok := splitIDLine(line)
+		if !ok {
+			continue
+		}
+		current = &pciVendorEntry{Name: name, Devices: make(map[string]string)}
+		db.Vendors[id] = current
+	}
+
+	return db
+}
+
+// splitIDLine splits a "<hex id>  <name>" pci.ids line into its id (kept
+// lowercase for lookups) and name.
+func splitIDLine(line string) (id, name string, ok bool) {
+	fields := strings.SplitN(line, "  ", 2)
+	if len(fields) != 2 {
+		return "", "", false
+	}
+	return strings.ToLower(strings.TrimSpace(fields[0])), strings.TrimSpace(fields[1]), true
+}
+
+// lookupVendorDevice resolves numeric vendor/device IDs (eg "8086",
+// "10fb") into their human-readable pci.ids names. Either return value may
+// be empty if the database has no entry for it.
+func lookupVendorDevice(vendorID, deviceID string) (vendorName, deviceName string) {
+	vendor, ok := getPCIIDs().Vendors[strings.ToLower(vendorID)]
+	if !ok {
+		return "", ""
+	}
+
+	return vendor.Name, vendor.Devices[strings.ToLower(deviceID)]
+}
+
+// readPCIIDAttr reads a numeric id sysfs attribute (vendor, device) for a
+// PCI device and normalises it to lowercase hex without the "0x" prefix.
+func readPCIIDAttr(bdf, attr string) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/sys/bus/pci/devices/%s/%s", bdf, attr))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(string(data)), "0x")), nil
+}
+
+// EnumeratePCIDevicesByClass returns the BDFs of every PCI device under
+// /sys/bus/pci/devices whose vendor and device id match vendorDeviceID
+// (eg "8086:10fb"), so a device can be selected by class instead of a
+// fixed BDF.
+func EnumeratePCIDevicesByClass(vendorDeviceID string) ([]string, error) {
+	tokens := strings.SplitN(vendorDeviceID, ":", 2)
+	if len(tokens) != 2 {
+		return nil, fmt.Errorf("invalid vendor:device selector: %s", vendorDeviceID)
+	}
+	vendorID, deviceID := strings.ToLower(tokens[0]), strings.ToLower(tokens[1])
+
+	entries, err := ioutil.ReadDir("/sys/bus/pci/devices")
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []string
+	for _, entry := range entries {
+		v, err := readPCIIDAttr(entry.Name(), "vendor")
+		if err != nil {
+			continue
+		}
+		d, err := readPCIIDAttr(entry.Name(), "device")
+		if err != nil {
+			continue
+		}
+		if v == vendorID && d == deviceID {
+			matches = append(matches, entry.Name())
+		}
+	}
+
+	return matches, nil
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2018 Huawei Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package drivers
+
+import (
+	"sync"
+	"testing"
+)
+
+const testPCIIDsData = `# comment line, should be skipped
+8086  Intel Corporation
+	10fb  82599ES 10-Gigabit SFI/SFP+ Network Connection
+		8086 0000  Subsystem line, should be skipped
+15b3  Mellanox Technologies
+	1013  MT27700 Family [ConnectX-4]
+`
+
+func TestParsePCIIDs(t *testing.T) {
+	db := parsePCIIDs([]byte(testPCIIDsData))
+
+	vendor, ok := db.Vendors["8086"]
+	if !ok {
+		t.Fatalf("parsePCIIDs: missing vendor 8086")
+	}
+	if vendor.Name != "Intel Corporation" {
+		t.Errorf("parsePCIIDs: vendor 8086 name = %q, want %q", vendor.Name, "Intel Corporation")
+	}
+	if got := vendor.Devices["10fb"]; got != "82599ES 10-Gigabit SFI/SFP+ Network Connection" {
+		t.Errorf("parsePCIIDs: device 8086:10fb name = %q", got)
+	}
+
+	if _, ok := db.Vendors["15b3"]; !ok {
+		t.Fatalf("parsePCIIDs: missing vendor 15b3")
+	}
+}
+
+func TestParsePCIIDsSkipsSubsystemLines(t *testing.T) {
+	db := parsePCIIDs([]byte(testPCIIDsData))
+
+	vendor := db.Vendors["8086"]
+	if _, ok := vendor.Devices["8086 0000"]; ok {
+		t.Error("parsePCIIDs: subsystem line was parsed as a device")
+	}
+}
+
+func TestSplitIDLine(t *testing.T) {
+	tests := []struct {
+		line     string
+		wantID   string
+		wantName string
+		wantOK   bool
+	}{
+		{"8086  Intel Corporation", "8086", "Intel Corporation", true},
+		{"10FB  82599ES 10-Gigabit SFI/SFP+ Network Connection", "10fb", "82599ES 10-Gigabit SFI/SFP+ Network Connection", true},
+		{"no-double-space-here", "", "", false},
+	}
+
+	for _, tt := range tests {
+		id, name, ok := splitIDLine(tt.line)
+		if ok != tt.wantOK {
+			t.Errorf("splitIDLine(%q): ok = %v, want %v", tt.line, ok, tt.wantOK)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if id != tt.wantID || name != tt.wantName {
+			t.Errorf("splitIDLine(%q) = (%q, %q), want (%q, %q)", tt.line, id, name, tt.wantID, tt.wantName)
+		}
+	}
+}
+
+func TestLookupVendorDevice(t *testing.T) {
+	savedIDs := pciIDs
+	defer func() {
+		pciIDs = savedIDs
+		pciIDsOnce = sync.Once{}
+	}()
+
+	pciIDsOnce.Do(func() {})
+	pciIDs = parsePCIIDs([]byte(testPCIIDsData))
+
+	vendorName, deviceName := lookupVendorDevice("8086", "10fb")
+	if vendorName != "Intel Corporation" {
+		t.Errorf("lookupVendorDevice: vendorName = %q, want %q", vendorName, "Intel Corporation")
+	}
+	if deviceName != "82599ES 10-Gigabit SFI/SFP+ Network Connection" {
+		t.Errorf("lookupVendorDevice: deviceName = %q", deviceName)
+	}
+
+	vendorName, deviceName = lookupVendorDevice("FFFF", "FFFF")
+	if vendorName != "" || deviceName != "" {
+		t.Errorf("lookupVendorDevice: unknown id returned (%q, %q), want empty", vendorName, deviceName)
+	}
+}
+
+func TestVendorDeviceSelectorRegex(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"8086:10fb", true},
+		{"0000:00:1c.0", false},
+		{"8086-10fb", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := vendorDeviceSelectorRegex.MatchString(tt.input); got != tt.want {
+			t.Errorf("vendorDeviceSelectorRegex.MatchString(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+// Copyright (c) 2018 Huawei Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package drivers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/kata-containers/runtime/virtcontainers/device/api"
+	"github.com/kata-containers/runtime/virtcontainers/device/config"
+	"github.com/kata-containers/runtime/virtcontainers/pkg/uevent"
+)
+
+// sysfs path to the attributes of a USB device, eg
+// /sys/bus/usb/devices/3-1/idVendor.
+const usbSysAttrPath = "/sys/bus/usb/devices/%s/%s"
+
+const usbDevicesPath = "/sys/bus/usb/devices"
+
+// usbSelectorRegex matches a vendor:product selector, eg 0781:5581.
+var usbSelectorRegex = regexp.MustCompile(`^[0-9a-fA-F]{4}:[0-9a-fA-F]{4}$`)
+
+// usbDevPathRegex matches a /dev/bus/usb/<bus>/<dev> host path.
+var usbDevPathRegex = regexp.MustCompile(`^/dev/bus/usb/(\d+)/(\d+)$`)
+
+// USBDevice is a USB device meant to be passed to the hypervisor
+// to be used by the Virtual Machine.
+type USBDevice struct {
+	ID         string
+	DeviceInfo *config.DeviceInfo
+	usbDev     *config.USBDev
+	// watcherHeld tracks whether Attach registered this device against
+	// the hotplug watcher's refcount, so Detach releases it at most once
+	// regardless of whether HotplugRemoveDevice itself succeeds.
+	watcherHeld bool
+}
+
+// NewUSBDevice creates a new USB device. devInfo.HostPath is expected to be
+// either a /dev/bus/usb/<bus>/<dev> node or a vendor:product selector (eg
+// "0781:5581"), in which case the first matching device found under
+// /sys/bus/usb/devices is used.
+func NewUSBDevice(devInfo *config.DeviceInfo) (*USBDevice, error) {
+	usbDev, err := getUSBDev(devInfo.HostPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &USBDevice{
+		ID:         devInfo.ID,
+		DeviceInfo: devInfo,
+		usbDev:     usbDev,
+	}, nil
+}
+
+// getUSBDev resolves hostPath, a /dev/bus/usb/<bus>/<dev> node or a
+// vendor:product selector, into a config.USBDev by reading the matching
+// entry's idVendor, idProduct, busnum and devnum attributes under
+// /sys/bus/usb/devices.
+func getUSBDev(hostPath string) (*config.USBDev, error) {
+	if usbSelectorRegex.MatchString(hostPath) {
+		return findUSBDevBySelector(hostPath)
+	}
+
+	matches := usbDevPathRegex.FindStringSubmatch(hostPath)
+	if matches == nil {
+		return nil, fmt.Errorf("unrecognised USB device path or selector: %s", hostPath)
+	}
+
+	// Device nodes are zero-padded (eg /dev/bus/usb/001/002), while the
+	// busnum/devnum sysfs attributes readUSBDev reads are not.
+	return findUSBDevByBusDev(trimLeadingZeros(matches[1]), trimLeadingZeros(matches[2]))
+}
+
+func findUSBDevBySelector(selector string) (*config.USBDev, error) {
+	tokens := strings.SplitN(selector, ":", 2)
+	vendorID, productID := tokens[0], tokens[1]
+
+	entries, err := ioutil.ReadDir(usbDevicesPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		usbDev, err := readUSBDev(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		if usbDev.VendorID == vendorID && usbDev.ProductID == productID {
+			return usbDev, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no USB device found matching selector %s", selector)
+}
+
+func findUSBDevByBusDev(busnum, devnum string) (*config.USBDev, error) {
+	entries, err := ioutil.ReadDir(usbDevicesPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		usbDev, err := readUSBDev(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		if usbDev.Bus == busnum && usbDev.Device == devnum {
+			return usbDev, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no USB device found at bus %s device %s", busnum, devnum)
+}
+
+func readUSBDev(sysName string) (*config.USBDev, error) {
+	vendorID, err := readUSBAttr(sysName, "idVendor")
+	if err != nil {
+		return nil, err
+	}
+
+	productID, err := readUSBAttr(sysName, "idProduct")
+	if err != nil {
+		return nil, err
+	}
+
+	busnum, err := readUSBAttr(sysName, "busnum")
+	if err != nil {
+		return nil, err
+	}
+
+	devnum, err := readUSBAttr(sysName, "devnum")
+	if err != nil {
+		return nil, err
+	}
+
+	return &config.USBDev{
+		VendorID:  vendorID,
+		ProductID: productID,
+		Bus:       busnum,
+		Device:    devnum,
+	}, nil
+}
+
+func readUSBAttr(sysName, attr string) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf(usbSysAttrPath, sysName, attr))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Attach is standard interface of api.Device, it's used to add device to some
+// DeviceReceiver
+func (device *USBDevice) Attach(devReceiver api.DeviceReceiver) error {
+	if device.DeviceInfo.Hotplugged {
+		return nil
+	}
+
+	if err := devReceiver.HotplugAddDevice(device, config.DeviceUSB); err != nil {
+		deviceLogger().WithError(err).Error("Failed to add device")
+		return err
+	}
+
+	ensureUSBHotplugWatcher(devReceiver)
+	device.watcherHeld = true
+
+	deviceLogger().WithFields(logrus.Fields{
+		"device-bus-dev": fmt.Sprintf("%s:%s", device.usbDev.Bus, device.usbDev.Device),
+		"device-type":    "usb-passthrough",
+	}).Info("Device attached")
+	device.DeviceInfo.Hotplugged = true
+	return nil
+}
+
+// Detach is standard interface of api.Device, it's used to remove device from some
+// DeviceReceiver
+func (device *USBDevice) Detach(devReceiver api.DeviceReceiver) error {
+	if !device.DeviceInfo.Hotplugged {
+		return nil
+	}
+
+	// Release the watcher reference as soon as Detach is attempted,
+	// independent of whether HotplugRemoveDevice below succeeds: the
+	// alternative is only releasing on success, which leaks the watcher
+	// forever whenever HotplugRemoveDevice fails on a teardown that's
+	// never retried (eg the sandbox is already gone).
+	if device.watcherHeld {
+		releaseUSBHotplugWatcher(devReceiver)
+		device.watcherHeld = false
+	}
+
+	if err := devReceiver.HotplugRemoveDevice(device, config.DeviceUSB); err != nil {
+		deviceLogger().WithError(err).Error("Failed to remove device")
+		return err
+	}
+
+	deviceLogger().WithFields(logrus.Fields{
+		"device-bus-dev": fmt.Sprintf("%s:%s", device.usbDev.Bus, device.usbDev.Device),
+		"device-type":    "usb-passthrough",
+	}).Info("Device detached")
+	device.DeviceInfo.Hotplugged = false
+	return nil
+}
+
+// IsAttached checks if the device is attached
+func (device *USBDevice) IsAttached() bool {
+	return device.DeviceInfo.Hotplugged
+}
+
+// DeviceType is standard interface of api.Device, it returns device type
+func (device *USBDevice) DeviceType() config.DeviceType {
+	return config.DeviceUSB
+}
+
+// DeviceID returns device ID
+func (device *USBDevice) DeviceID() string {
+	return device.ID
+}
+
+// GetDeviceInfo returns device information used for creating
+func (device *USBDevice) GetDeviceInfo() interface{} {
+	return device.usbDev
+}
+
+// usbHotplugEvent describes a USB device that appeared or disappeared
+// under /sys/bus/usb/devices after sandbox start, as reported by the
+// kernel's uevent stream.
+type usbHotplugEvent struct {
+	USBDev *config.USBDev
+	Added  bool
+}
+
+// usbHotplugWatcher tracks a devReceiver's USB uevent subscription and how
+// many currently-attached USBDevices are keeping it alive, so the last
+// Detach tears it down instead of leaking it for the life of the process.
+type usbHotplugWatcher struct {
+	cancel   func()
+	refcount int
+}
+
+// usbHotplugReceivers tracks which devReceivers already have a hotplug
+// watcher goroutine running, so a runtime process managing more than one
+// sandbox wires up every sandbox's devReceiver, not just the first.
+var (
+	usbHotplugMu        sync.Mutex
+	usbHotplugReceivers = make(map[api.DeviceReceiver]*usbHotplugWatcher)
+)
+
+// ensureUSBHotplugWatcher lazily starts the background goroutine that
+// turns USB uevents into usbHotplugEvents for devReceiver, and bumps its
+// refcount. It's safe to call from every USBDevice.Attach; each distinct
+// devReceiver only gets its own watcher goroutine started once. Every
+// successful call must be matched by a releaseUSBHotplugWatcher once the
+// device is detached, or the watcher is never torn down.
+func ensureUSBHotplugWatcher(devReceiver api.DeviceReceiver) {
+	usbHotplugMu.Lock()
+	defer usbHotplugMu.Unlock()
+
+	if w, ok := usbHotplugReceivers[devReceiver]; ok {
+		w.refcount++
+		return
+	}
+
+	watcher, err := getUeventWatcher()
+	if err != nil {
+		deviceLogger().WithError(err).Error("Failed to start USB hotplug watcher")
+		return
+	}
+
+	events, cancel := watcher.Subscribe("usb")
+	go StartUSBHotplugWatcher(devReceiver, events)
+	usbHotplugReceivers[devReceiver] = &usbHotplugWatcher{cancel: cancel, refcount: 1}
+}
+
+// releaseUSBHotplugWatcher drops devReceiver's refcount, cancelling its USB
+// uevent subscription and tearing down its watcher goroutine once the last
+// device attached under devReceiver has been detached.
+func releaseUSBHotplugWatcher(devReceiver api.DeviceReceiver) {
+	usbHotplugMu.Lock()
+	defer usbHotplugMu.Unlock()
+
+	w, ok := usbHotplugReceivers[devReceiver]
+	if !ok {
+		return
+	}
+
+	w.refcount--
+	if w.refcount > 0 {
+		return
+	}
+
+	w.cancel()
+	delete(usbHotplugReceivers, devReceiver)
+}
+
+// StartUSBHotplugWatcher translates raw USB uevents into usbHotplugEvents
+// and feeds them to watchHotplugUSB. It runs until events is closed.
+func StartUSBHotplugWatcher(devReceiver api.DeviceReceiver, events <-chan uevent.Event) {
+	hotplugEvents := make(chan usbHotplugEvent)
+	go watchHotplugUSB(devReceiver, hotplugEvents)
+
+	for ev := range events {
+		hotplugEvent, ok := usbDevFromUevent(ev)
+		if !ok {
+			continue
+		}
+		hotplugEvents <- hotplugEvent
+	}
+
+	close(hotplugEvents)
+}
+
+// usbDevFromUevent translates a raw "usb" subsystem uevent carrying
+// BUSNUM/DEVNUM/PRODUCT fields into a usbHotplugEvent. PRODUCT is of the
+// form "<vendorID>/<productID>/<bcdDevice>" in hex without leading zeros,
+// eg "46d/c52b/1200" for vendor 046d product c52b; VendorID/ProductID are
+// zero-padded to 4 hex digits to match the idVendor/idProduct sysfs
+// attributes readUSBDev uses, so the two paths produce comparable ids.
+// BUSNUM/DEVNUM are zero-padded decimal (eg "001"), while readUSBDev's
+// busnum/devnum sysfs attributes are unpadded (eg "1"); trimLeadingZeros
+// brings them in line the same way. Only "add" and "remove" actions are
+// translated; any other action (eg "bind", "change") is dropped.
+func usbDevFromUevent(ev uevent.Event) (usbHotplugEvent, bool) {
+	if ev.Action != "add" && ev.Action != "remove" {
+		return usbHotplugEvent{}, false
+	}
+
+	busnum := ev.Field("BUSNUM")
+	devnum := ev.Field("DEVNUM")
+	product := ev.Field("PRODUCT")
+	if busnum == "" || devnum == "" || product == "" {
+		return usbHotplugEvent{}, false
+	}
+
+	tokens := strings.SplitN(product, "/", 3)
+	if len(tokens) < 2 {
+		return usbHotplugEvent{}, false
+	}
+
+	return usbHotplugEvent{
+		USBDev: &config.USBDev{
+			VendorID:  zeroPadHex4(tokens[0]),
+			ProductID: zeroPadHex4(tokens[1]),
+			Bus:       trimLeadingZeros(busnum),
+			Device:    trimLeadingZeros(devnum),
+		},
+		Added: ev.Action == "add",
+	}, true
+}
+
+// zeroPadHex4 left-pads a hex string with zeros to 4 digits, eg "46d" ->
+// "046d". Strings already 4 digits or longer are returned unchanged.
+func zeroPadHex4(hex string) string {
+	if len(hex) >= 4 {
+		return hex
+	}
+	return strings.Repeat("0", 4-len(hex)) + hex
+}
+
+// trimLeadingZeros strips leading zeros from a decimal string, eg "001"
+// -> "1", leaving a lone "0" alone. Used to match the unpadded busnum
+// and devnum sysfs attributes readUSBDev reads.
+func trimLeadingZeros(decimal string) string {
+	trimmed := strings.TrimLeft(decimal, "0")
+	if trimmed == "" {
+		return "0"
+	}
+	return trimmed
+}
+
+// watchHotplugUSB consumes USB add/remove uevents and surfaces them to
+// devReceiver, so a USB device plugged into the host after the sandbox
+// started can still be passed through without a runtime restart.
+func watchHotplugUSB(devReceiver api.DeviceReceiver, events <-chan usbHotplugEvent) {
+	for ev := range events {
+		if err := devReceiver.HotplugUpdateDevice(ev.USBDev, config.DeviceUSB, ev.Added); err != nil {
+			deviceLogger().WithError(err).WithFields(logrus.Fields{
+				"device-bus-dev": fmt.Sprintf("%s:%s", ev.USBDev.Bus, ev.USBDev.Device),
+				"added":          ev.Added,
+			}).Error("Failed to handle USB hotplug uevent")
+		}
+	}
+}
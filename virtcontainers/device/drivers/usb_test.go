@@ -0,0 +1,160 @@
+// Copyright (c) 2018 Huawei Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package drivers
+
+import (
+	"testing"
+
+	"github.com/kata-containers/runtime/virtcontainers/pkg/uevent"
+)
+
+func TestUSBSelectorRegex(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"0781:5581", true},
+		{"0000:ffff", true},
+		{"0781-5581", false},
+		{"/dev/bus/usb/001/002", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := usbSelectorRegex.MatchString(tt.input); got != tt.want {
+			t.Errorf("usbSelectorRegex.MatchString(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestUSBDevPathRegex(t *testing.T) {
+	tests := []struct {
+		input      string
+		wantMatch  bool
+		wantBus    string
+		wantDevice string
+	}{
+		{"/dev/bus/usb/001/002", true, "001", "002"},
+		{"/dev/bus/usb/3/7", true, "3", "7"},
+		{"0781:5581", false, "", ""},
+		{"/dev/bus/usb/001", false, "", ""},
+	}
+
+	for _, tt := range tests {
+		matches := usbDevPathRegex.FindStringSubmatch(tt.input)
+		if tt.wantMatch != (matches != nil) {
+			t.Errorf("usbDevPathRegex.FindStringSubmatch(%q): match = %v, want %v", tt.input, matches != nil, tt.wantMatch)
+			continue
+		}
+		if !tt.wantMatch {
+			continue
+		}
+		if matches[1] != tt.wantBus || matches[2] != tt.wantDevice {
+			t.Errorf("usbDevPathRegex.FindStringSubmatch(%q) = %v, want bus %q device %q", tt.input, matches, tt.wantBus, tt.wantDevice)
+		}
+	}
+}
+
+func TestGetUSBDevRejectsUnrecognisedPath(t *testing.T) {
+	if _, err := getUSBDev("not-a-usb-path"); err == nil {
+		t.Error("getUSBDev(\"not-a-usb-path\"): expected error, got none")
+	}
+}
+
+func TestUSBDevFromUevent(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  map[string]string
+		action  string
+		wantOK  bool
+		wantDev bool
+	}{
+		{
+			name:   "valid add event",
+			fields: map[string]string{"BUSNUM": "001", "DEVNUM": "005", "PRODUCT": "46d/c52b/1200"},
+			action: "add",
+			wantOK: true,
+		},
+		{
+			name:   "valid remove event",
+			fields: map[string]string{"BUSNUM": "001", "DEVNUM": "005", "PRODUCT": "46d/c52b/1200"},
+			action: "remove",
+			wantOK: true,
+		},
+		{
+			name:   "missing PRODUCT",
+			fields: map[string]string{"BUSNUM": "001", "DEVNUM": "005"},
+			action: "add",
+			wantOK: false,
+		},
+		{
+			name:   "missing BUSNUM",
+			fields: map[string]string{"DEVNUM": "005", "PRODUCT": "46d/c52b/1200"},
+			action: "add",
+			wantOK: false,
+		},
+	}
+
+	for _, tt := range tests {
+		ev := uevent.NewEvent(tt.action, "usb", tt.fields)
+
+		hotplugEv, ok := usbDevFromUevent(ev)
+		if ok != tt.wantOK {
+			t.Errorf("%s: usbDevFromUevent() ok = %v, want %v", tt.name, ok, tt.wantOK)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if hotplugEv.USBDev.VendorID != "046d" || hotplugEv.USBDev.ProductID != "c52b" {
+			t.Errorf("%s: usbDevFromUevent() vendor/product = %s/%s, want 046d/c52b", tt.name, hotplugEv.USBDev.VendorID, hotplugEv.USBDev.ProductID)
+		}
+		if hotplugEv.USBDev.Bus != "1" || hotplugEv.USBDev.Device != "5" {
+			t.Errorf("%s: usbDevFromUevent() bus/device = %s/%s, want 1/5", tt.name, hotplugEv.USBDev.Bus, hotplugEv.USBDev.Device)
+		}
+		if hotplugEv.Added != (tt.action == "add") {
+			t.Errorf("%s: usbDevFromUevent() Added = %v, want %v", tt.name, hotplugEv.Added, tt.action == "add")
+		}
+	}
+}
+
+func TestZeroPadHex4(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"46d", "046d"},
+		{"d", "000d"},
+		{"c52b", "c52b"},
+		{"10de1234", "10de1234"},
+	}
+
+	for _, tt := range tests {
+		if got := zeroPadHex4(tt.input); got != tt.want {
+			t.Errorf("zeroPadHex4(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestTrimLeadingZeros(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"001", "1"},
+		{"005", "5"},
+		{"000", "0"},
+		{"10", "10"},
+		{"1", "1"},
+	}
+
+	for _, tt := range tests {
+		if got := trimLeadingZeros(tt.input); got != tt.want {
+			t.Errorf("trimLeadingZeros(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
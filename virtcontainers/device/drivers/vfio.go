@@ -7,27 +7,55 @@
 package drivers
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/kata-containers/runtime/virtcontainers/device/api"
 	"github.com/kata-containers/runtime/virtcontainers/device/config"
+	"github.com/kata-containers/runtime/virtcontainers/pkg/hostdev"
+	"github.com/kata-containers/runtime/virtcontainers/pkg/uevent"
 	"github.com/kata-containers/runtime/virtcontainers/utils"
 )
 
-// bind/unbind paths to aid in SRIOV VF bring-up/restore
-const (
-	pciDriverUnbindPath = "/sys/bus/pci/devices/%s/driver/unbind"
-	pciDriverBindPath   = "/sys/bus/pci/drivers/%s/bind"
-	vfioNewIDPath       = "/sys/bus/pci/drivers/vfio-pci/new_id"
-	vfioRemoveIDPath    = "/sys/bus/pci/drivers/vfio-pci/remove_id"
+// waitForDeviceTimeout bounds how long Attach waits on the host's netlink
+// bus for a uevent naming a passed-through device before giving up.
+const waitForDeviceTimeout = 10 * time.Second
+
+var (
+	ueventWatcher     *uevent.Watcher
+	ueventWatcherErr  error
+	ueventWatcherOnce sync.Once
 )
 
+// getUeventWatcher lazily starts the package-wide host uevent watcher
+// (see pkg/uevent's package doc for what it can and can't observe).
+func getUeventWatcher() (*uevent.Watcher, error) {
+	ueventWatcherOnce.Do(func() {
+		ueventWatcher, ueventWatcherErr = uevent.NewWatcher()
+	})
+	return ueventWatcher, ueventWatcherErr
+}
+
+// vfioDriver is the kernel driver vfio-pci devices are bound to.
+const vfioDriver = "vfio-pci"
+
+// boundDrivers remembers, per device id, the host driver a device was
+// bound to before it was switched over to vfio-pci, so that
+// BindDevicetoHost can restore it without requiring the caller to track it.
+var boundDrivers = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
 // VFIODevice is a vfio device meant to be passed to the hypervisor
 // to be used by the Virtual Machine.
 type VFIODevice struct {
@@ -44,6 +72,42 @@ func NewVFIODevice(devInfo *config.DeviceInfo) *VFIODevice {
 	}
 }
 
+// vendorDeviceSelectorRegex matches a "vendor:device" class selector, eg
+// 8086:10fb, as opposed to a HostPath that already names an IOMMU group.
+var vendorDeviceSelectorRegex = regexp.MustCompile(`^[0-9a-fA-F]{4}:[0-9a-fA-F]{4}$`)
+
+// resolveHostPath translates hostPath into an IOMMU group path under
+// config.SysIOMMUPath. If hostPath is already such a path, it's returned
+// unchanged; if it's a "vendor:device" selector, the single matching PCI
+// device found by EnumeratePCIDevicesByClass is resolved to its IOMMU
+// group via its iommu_group sysfs symlink, so device configuration can
+// select devices by class instead of a fixed BDF/group. A selector that
+// matches no device, or more than one, is an error.
+func resolveHostPath(hostPath string) (string, error) {
+	if !vendorDeviceSelectorRegex.MatchString(hostPath) {
+		return hostPath, nil
+	}
+
+	bdfs, err := EnumeratePCIDevicesByClass(hostPath)
+	if err != nil {
+		return "", err
+	}
+	switch len(bdfs) {
+	case 0:
+		return "", fmt.Errorf("no PCI device found matching vendor:device selector %s", hostPath)
+	case 1:
+	default:
+		return "", fmt.Errorf("vendor:device selector %s is ambiguous: matches %v, pass an IOMMU group path instead", hostPath, bdfs)
+	}
+
+	target, err := os.Readlink(filepath.Join("/sys/bus/pci/devices", bdfs[0], "iommu_group"))
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(config.SysIOMMUPath, filepath.Base(target)), nil
+}
+
 // Attach is standard interface of api.Device, it's used to add device to some
 // DeviceReceiver
 func (device *VFIODevice) Attach(devReceiver api.DeviceReceiver) error {
@@ -51,7 +115,12 @@ func (device *VFIODevice) Attach(devReceiver api.DeviceReceiver) error {
 		return nil
 	}
 
-	vfioGroup := filepath.Base(device.DeviceInfo.HostPath)
+	hostPath, err := resolveHostPath(device.DeviceInfo.HostPath)
+	if err != nil {
+		return err
+	}
+
+	vfioGroup := filepath.Base(hostPath)
 	iommuDevicesPath := filepath.Join(config.SysIOMMUPath, vfioGroup, "devices")
 
 	deviceFiles, err := ioutil.ReadDir(iommuDevicesPath)
@@ -61,15 +130,20 @@ func (device *VFIODevice) Attach(devReceiver api.DeviceReceiver) error {
 
 	// Pass all devices in iommu group
 	for i, deviceFile := range deviceFiles {
-		//Get bdf of device eg 0000:00:1c.0
-		deviceBDF, err := getBDF(deviceFile.Name())
+		hdev, err := hostdev.New(deviceFile.Name())
 		if err != nil {
 			return err
 		}
 		vfio := &config.VFIODev{
 			ID:  utils.MakeNameID("vfio", device.DeviceInfo.ID+strconv.Itoa(i), maxDevIDSize),
-			BDF: deviceBDF,
+			BDF: hdev.ID(),
+			Bus: hdev.Bus(),
 		}
+
+		if hdev.Bus() == hostdev.BusPCI {
+			annotateVendorDevice(vfio)
+		}
+
 		device.vfioDevs = append(device.vfioDevs, vfio)
 	}
 
@@ -79,6 +153,8 @@ func (device *VFIODevice) Attach(devReceiver api.DeviceReceiver) error {
 		return err
 	}
 
+	device.waitForGuestDevices()
+
 	deviceLogger().WithFields(logrus.Fields{
 		"device-group": device.DeviceInfo.HostPath,
 		"device-type":  "vfio-passthrough",
@@ -87,6 +163,80 @@ func (device *VFIODevice) Attach(devReceiver api.DeviceReceiver) error {
 	return nil
 }
 
+// annotateVendorDevice looks up vfio's vendor and device ids in the
+// pci.ids database and, if found, stamps their human-readable names onto
+// it and logs them, so operators don't have to decode numeric ids
+// themselves when reading logs or the shim's device list.
+func annotateVendorDevice(vfio *config.VFIODev) {
+	vendorID, err := readPCIIDAttr(vfio.BDF, "vendor")
+	if err != nil {
+		return
+	}
+
+	deviceID, err := readPCIIDAttr(vfio.BDF, "device")
+	if err != nil {
+		return
+	}
+
+	vendorName, deviceName := lookupVendorDevice(vendorID, deviceID)
+	vfio.VendorName = vendorName
+	vfio.DeviceName = deviceName
+
+	deviceLogger().WithFields(logrus.Fields{
+		"device-bdf":  vfio.BDF,
+		"vendor-name": vendorName,
+		"device-name": deviceName,
+	}).Info("Resolved vendor and device name")
+}
+
+// waitForGuestDevices waits, concurrently for every PCI device in the
+// group and bounded by a single shared waitForDeviceTimeout, on the
+// host's own netlink bus for a uevent naming it, recording whatever name
+// turns up on config.VFIODev.GuestDevName. Devices are skipped with a
+// warning rather than failing Attach, since no name is ever guaranteed;
+// waiting concurrently keeps Attach's worst case at one timeout no matter
+// how many devices are in the group.
+//
+// This is host-local and cannot see inside the guest: the guest VM runs
+// its own kernel with an independent uevent namespace, and once a device
+// is unbound from its host driver for vfio-pci the host typically raises
+// no further uevents for it at all, so in practice GuestDevName is
+// expected to stay unset here and this call times out. Actually learning
+// the name the guest kernel gave the device requires a channel into the
+// guest itself (eg the agent RPC over vsock), which this package does not
+// provide; treat GuestDevName as best-effort until that exists.
+func (device *VFIODevice) waitForGuestDevices() {
+	watcher, err := getUeventWatcher()
+	if err != nil {
+		deviceLogger().WithError(err).Warn("Failed to start uevent watcher, device names won't be resolved")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitForDeviceTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, vfio := range device.vfioDevs {
+		if vfio.Bus != hostdev.BusPCI {
+			continue
+		}
+
+		wg.Add(1)
+		go func(vfio *config.VFIODev) {
+			defer wg.Done()
+
+			devName, err := watcher.WaitForDevice(ctx, vfio.BDF)
+			if err != nil {
+				deviceLogger().WithError(err).WithField("device-bdf", vfio.BDF).Warn("Timed out waiting for a uevent naming the device")
+				return
+			}
+
+			vfio.GuestDevName = devName
+		}(vfio)
+	}
+	wg.Wait()
+}
+
 // Detach is standard interface of api.Device, it's used to remove device from some
 // DeviceReceiver
 func (device *VFIODevice) Detach(devReceiver api.DeviceReceiver) error {
@@ -128,82 +278,78 @@ func (device *VFIODevice) GetDeviceInfo() interface{} {
 	return device.vfioDevs
 }
 
-// getBDF returns the BDF of pci device
-// Expected input strng format is [<domain>]:[<bus>][<slot>].[<func>] eg. 0000:02:10.0
-func getBDF(deviceSysStr string) (string, error) {
-	tokens := strings.Split(deviceSysStr, ":")
-
-	if len(tokens) != 3 {
-		return "", fmt.Errorf("Incorrect number of tokens found while parsing bdf for device : %s", deviceSysStr)
+// BindDevicetoVFIO binds the device to vfio driver after unbinding from host.
+// Will be called by a network interface or a generic passthrough device on
+// any of the buses hostdev.New recognises (pci, vmbus, vdpa).
+//
+// The host driver the device was bound to is recorded so that a later
+// BindDevicetoHost call can restore it without the caller having to track
+// it.
+func BindDevicetoVFIO(id, hostDriver string) error {
+	dev, err := hostdev.New(id)
+	if err != nil {
+		return err
 	}
 
-	tokens = strings.SplitN(deviceSysStr, ":", 2)
-	return tokens[1], nil
-}
+	if driver, err := dev.CurrentDriver(); err != nil {
+		deviceLogger().WithError(err).WithField("device-id", id).Warn("Failed to read current driver of device")
+	} else if driver != "" {
+		hostDriver = driver
+	}
 
-// BindDevicetoVFIO binds the device to vfio driver after unbinding from host.
-// Will be called by a network interface or a generic pcie device.
-func BindDevicetoVFIO(bdf, hostDriver, vendorDeviceID string) error {
+	boundDrivers.Lock()
+	boundDrivers.m[id] = hostDriver
+	boundDrivers.Unlock()
 
-	// Unbind from the host driver
-	unbindDriverPath := fmt.Sprintf(pciDriverUnbindPath, bdf)
 	deviceLogger().WithFields(logrus.Fields{
-		"device-bdf":  bdf,
-		"driver-path": unbindDriverPath,
+		"device-id":  id,
+		"device-bus": dev.Bus(),
 	}).Info("Unbinding device from driver")
 
-	if err := utils.WriteToFile(unbindDriverPath, []byte(bdf)); err != nil {
+	if err := dev.Unbind(); err != nil {
 		return err
 	}
 
-	// Add device id to vfio driver.
 	deviceLogger().WithFields(logrus.Fields{
-		"vendor-device-id": vendorDeviceID,
-		"vfio-new-id-path": vfioNewIDPath,
-	}).Info("Writing vendor-device-id to vfio new-id path")
-
-	if err := utils.WriteToFile(vfioNewIDPath, []byte(vendorDeviceID)); err != nil {
-		return err
-	}
-
-	// Bind to vfio-pci driver.
-	bindDriverPath := fmt.Sprintf(pciDriverBindPath, "vfio-pci")
-
-	api.DeviceLogger().WithFields(logrus.Fields{
-		"device-bdf":  bdf,
-		"driver-path": bindDriverPath,
+		"device-id":  id,
+		"device-bus": dev.Bus(),
 	}).Info("Binding device to vfio driver")
 
-	// Device may be already bound at this time because of earlier write to new_id, ignore error
-	utils.WriteToFile(bindDriverPath, []byte(bdf))
-
-	return nil
+	return dev.Bind(vfioDriver)
 }
 
 // BindDevicetoHost binds the device to the host driver driver after unbinding from vfio-pci.
-func BindDevicetoHost(bdf, hostDriver, vendorDeviceID string) error {
-	// Unbind from vfio-pci driver
-	unbindDriverPath := fmt.Sprintf(pciDriverUnbindPath, bdf)
-	api.DeviceLogger().WithFields(logrus.Fields{
-		"device-bdf":  bdf,
-		"driver-path": unbindDriverPath,
-	}).Info("Unbinding device from driver")
-
-	if err := utils.WriteToFile(unbindDriverPath, []byte(bdf)); err != nil {
+//
+// If the device was previously bound through BindDevicetoVFIO, the host
+// driver it was bound to at that time takes precedence over hostDriver, so
+// callers no longer need to track and pass it themselves.
+func BindDevicetoHost(id, hostDriver string) error {
+	dev, err := hostdev.New(id)
+	if err != nil {
 		return err
 	}
 
-	// To prevent new VFs from binding to VFIO-PCI, remove_id
-	if err := utils.WriteToFile(vfioRemoveIDPath, []byte(vendorDeviceID)); err != nil {
+	boundDrivers.Lock()
+	if saved, ok := boundDrivers.m[id]; ok && saved != "" {
+		hostDriver = saved
+		delete(boundDrivers.m, id)
+	}
+	boundDrivers.Unlock()
+
+	api.DeviceLogger().WithFields(logrus.Fields{
+		"device-id":  id,
+		"device-bus": dev.Bus(),
+	}).Info("Unbinding device from driver")
+
+	if err := dev.Unbind(); err != nil {
 		return err
 	}
 
-	// Bind back to host driver
-	bindDriverPath := fmt.Sprintf(pciDriverBindPath, hostDriver)
 	api.DeviceLogger().WithFields(logrus.Fields{
-		"device-bdf":  bdf,
-		"driver-path": bindDriverPath,
+		"device-id":   id,
+		"device-bus":  dev.Bus(),
+		"host-driver": hostDriver,
 	}).Info("Binding back device to host driver")
 
-	return utils.WriteToFile(bindDriverPath, []byte(bdf))
+	return dev.Restore(hostDriver)
 }
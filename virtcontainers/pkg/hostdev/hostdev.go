@@ -0,0 +1,272 @@
+// Copyright (c) 2018 Huawei Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+// Package hostdev abstracts binding and unbinding a host device from one
+// kernel driver to another across the bus types the runtime passes
+// through to a VM (pci, vmbus, vdpa), so callers don't need bus-specific
+// sysfs knowledge.
+package hostdev
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/kata-containers/runtime/virtcontainers/utils"
+)
+
+// Bus names returned by Device.Bus().
+const (
+	BusPCI   = "pci"
+	BusVMBus = "vmbus"
+	BusVDPA  = "vdpa"
+)
+
+// Device is a host device that can be rebound between kernel drivers.
+type Device interface {
+	// Bind attaches the device to driver, pinning it there via
+	// driver_override where the kernel supports it.
+	Bind(driver string) error
+	// Restore reverts a prior Bind, returning the device to driver
+	// without leaving a driver_override pinned in place: where
+	// driver_override is supported its value is cleared and the bus
+	// re-probed so the kernel matches drivers normally again, instead of
+	// permanently forcing driver.
+	Restore(driver string) error
+	// Unbind detaches the device from whatever driver it is currently
+	// bound to.
+	Unbind() error
+	// CurrentDriver returns the name of the driver the device is
+	// currently bound to, or "" if it isn't bound to any driver.
+	CurrentDriver() (string, error)
+	// Probe asks the bus to match the device against its registered
+	// drivers, after Bind has set up a driver_override.
+	Probe() error
+	// ID returns the device's identifier on its bus, eg a PCI BDF or a
+	// VMBus instance UUID.
+	ID() string
+	// Bus returns the name of the bus the device lives on (pci, vmbus,
+	// vdpa).
+	Bus() string
+}
+
+// pciBDFRegex matches a full PCI BDF, eg 0000:02:10.0.
+var pciBDFRegex = regexp.MustCompile(`^[0-9a-fA-F]{4}:[0-9a-fA-F]{2}:[0-9a-fA-F]{2}\.[0-9a-fA-F]$`)
+
+// vmbusIDRegex matches a Hyper-V VMBus instance UUID, eg
+// f8615163-df3e-46c5-913f-f2d2f965ed0e.
+var vmbusIDRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// New returns the Device implementation matching the format of input: a
+// PCI BDF, a VMBus instance UUID, or (anything else) a vdpa device name.
+func New(input string) (Device, error) {
+	switch {
+	case pciBDFRegex.MatchString(input):
+		return &pciDevice{busDevice{id: input, bus: BusPCI}}, nil
+	case vmbusIDRegex.MatchString(input):
+		return &vmbusDevice{busDevice{id: input, bus: BusVMBus}}, nil
+	case input != "":
+		return &vdpaDevice{busDevice{id: input, bus: BusVDPA}}, nil
+	default:
+		return nil, fmt.Errorf("cannot determine device type for empty id")
+	}
+}
+
+// busDevice implements the sysfs-generic parts of Device shared by every
+// /sys/bus/<bus>/devices/<id> bus.
+type busDevice struct {
+	id  string
+	bus string
+}
+
+func (d busDevice) ID() string  { return d.id }
+func (d busDevice) Bus() string { return d.bus }
+
+func (d busDevice) devicePath(elem ...string) string {
+	return filepath.Join(append([]string{"/sys/bus", d.bus, "devices", d.id}, elem...)...)
+}
+
+func (d busDevice) driversProbePath() string {
+	return filepath.Join("/sys/bus", d.bus, "drivers_probe")
+}
+
+func (d busDevice) driverBindPath(driver string) string {
+	return filepath.Join("/sys/bus", d.bus, "drivers", driver, "bind")
+}
+
+func (d busDevice) CurrentDriver() (string, error) {
+	target, err := os.Readlink(d.devicePath("driver"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return filepath.Base(target), nil
+}
+
+func (d busDevice) Unbind() error {
+	return utils.WriteToFile(d.devicePath("driver", "unbind"), []byte(d.id))
+}
+
+func (d busDevice) supportsDriverOverride() bool {
+	_, err := os.Stat(d.devicePath("driver_override"))
+	return err == nil
+}
+
+func (d busDevice) setDriverOverride(driver string) error {
+	return utils.WriteToFile(d.devicePath("driver_override"), []byte(driver))
+}
+
+func (d busDevice) Probe() error {
+	return utils.WriteToFile(d.driversProbePath(), []byte(d.id))
+}
+
+func (d busDevice) bindByOverride(driver string) error {
+	if err := d.setDriverOverride(driver); err != nil {
+		return err
+	}
+	return d.Probe()
+}
+
+// restoreByOverride clears a driver_override left by bindByOverride and
+// re-probes, so the kernel goes back to matching drivers against this
+// device normally instead of staying pinned to whatever Bind last set.
+func (d busDevice) restoreByOverride() error {
+	if err := d.setDriverOverride(""); err != nil {
+		return err
+	}
+	return d.Probe()
+}
+
+func (d busDevice) bindDirect(driver string) error {
+	return utils.WriteToFile(d.driverBindPath(driver), []byte(d.id))
+}
+
+// pciDevice is a device on the PCI bus.
+type pciDevice struct {
+	busDevice
+}
+
+const (
+	vfioDriver       = "vfio-pci"
+	vfioNewIDPath    = "/sys/bus/pci/drivers/vfio-pci/new_id"
+	vfioRemoveIDPath = "/sys/bus/pci/drivers/vfio-pci/remove_id"
+)
+
+// pciVendorDeviceID returns the "vendor:device" numeric ID the vfio-pci
+// new_id/remove_id legacy interface expects, read from the device's own
+// vendor and device sysfs attributes.
+func (d *pciDevice) pciVendorDeviceID() (string, error) {
+	vendor, err := os.ReadFile(d.devicePath("vendor"))
+	if err != nil {
+		return "", err
+	}
+
+	device, err := os.ReadFile(d.devicePath("device"))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s:%s", strings.TrimPrefix(strings.TrimSpace(string(vendor)), "0x"),
+		strings.TrimPrefix(strings.TrimSpace(string(device)), "0x")), nil
+}
+
+// bindLegacy implements the new_id/remove_id fallback used on kernels
+// without a driver_override attribute: binding to vfio-pci needs new_id
+// to claim a device outside its static ID table, while binding away from
+// it needs remove_id first, so a future VF sharing this vendor:device id
+// doesn't silently get claimed by vfio-pci instead of driver.
+func (d *pciDevice) bindLegacy(driver string) error {
+	vendorDeviceID, err := d.pciVendorDeviceID()
+	if err != nil {
+		return err
+	}
+
+	path := vfioRemoveIDPath
+	if driver == vfioDriver {
+		path = vfioNewIDPath
+	}
+	if err := utils.WriteToFile(path, []byte(vendorDeviceID)); err != nil {
+		return err
+	}
+
+	// When binding to vfio-pci the device may already be bound at this
+	// point because of the new_id write above, so that error is ignored.
+	if err := d.bindDirect(driver); err != nil && driver != vfioDriver {
+		return err
+	}
+	return nil
+}
+
+// Bind attaches the pci device to driver, preferring the per-device
+// driver_override attribute so only this device is rebound. On kernels
+// without driver_override, it falls back to bindLegacy.
+func (d *pciDevice) Bind(driver string) error {
+	if d.supportsDriverOverride() {
+		return d.bindByOverride(driver)
+	}
+	return d.bindLegacy(driver)
+}
+
+// Restore reverts a prior Bind, returning the device to driver. Where
+// driver_override is supported its value is cleared and the bus
+// re-probed, rather than pinning driver_override to driver forever; on
+// kernels without driver_override there's no pinning to undo, so this
+// falls back to the same path Bind uses.
+func (d *pciDevice) Restore(driver string) error {
+	if d.supportsDriverOverride() {
+		return d.restoreByOverride()
+	}
+	return d.bindLegacy(driver)
+}
+
+// vmbusDevice is a device on the Hyper-V VMBus.
+type vmbusDevice struct {
+	busDevice
+}
+
+// Bind attaches the vmbus device to driver via driver_override; VMBus has
+// no new_id-style fallback, so driver_override support is required.
+func (d *vmbusDevice) Bind(driver string) error {
+	if !d.supportsDriverOverride() {
+		return fmt.Errorf("vmbus device %s: driver_override is required but not supported by this kernel", d.id)
+	}
+	return d.bindByOverride(driver)
+}
+
+// Restore reverts a prior Bind by clearing driver_override and
+// re-probing, rather than leaving it pinned to driver forever.
+func (d *vmbusDevice) Restore(driver string) error {
+	if !d.supportsDriverOverride() {
+		return fmt.Errorf("vmbus device %s: driver_override is required but not supported by this kernel", d.id)
+	}
+	return d.restoreByOverride()
+}
+
+// vdpaDevice is a vdpa (virtio data path acceleration) device.
+type vdpaDevice struct {
+	busDevice
+}
+
+// Bind attaches the vdpa device to driver via driver_override.
+func (d *vdpaDevice) Bind(driver string) error {
+	if !d.supportsDriverOverride() {
+		return fmt.Errorf("vdpa device %s: driver_override is required but not supported by this kernel", d.id)
+	}
+	return d.bindByOverride(driver)
+}
+
+// Restore reverts a prior Bind by clearing driver_override and
+// re-probing, rather than leaving it pinned to driver forever.
+func (d *vdpaDevice) Restore(driver string) error {
+	if !d.supportsDriverOverride() {
+		return fmt.Errorf("vdpa device %s: driver_override is required but not supported by this kernel", d.id)
+	}
+	return d.restoreByOverride()
+}
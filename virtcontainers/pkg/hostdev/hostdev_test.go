@@ -0,0 +1,44 @@
+// Copyright (c) 2018 Huawei Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package hostdev
+
+import "testing"
+
+func TestNewDispatchesByIDFormat(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantBus string
+		wantErr bool
+	}{
+		{"0000:02:10.0", BusPCI, false},
+		{"0000:00:1c.0", BusPCI, false},
+		{"f8615163-df3e-46c5-913f-f2d2f965ed0e", BusVMBus, false},
+		{"vdpa0", BusVDPA, false},
+		{"", "", true},
+	}
+
+	for _, tt := range tests {
+		dev, err := New(tt.input)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("New(%q): expected error, got none", tt.input)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("New(%q): unexpected error: %v", tt.input, err)
+		}
+
+		if dev.Bus() != tt.wantBus {
+			t.Errorf("New(%q).Bus() = %q, want %q", tt.input, dev.Bus(), tt.wantBus)
+		}
+
+		if dev.ID() != tt.input {
+			t.Errorf("New(%q).ID() = %q, want %q", tt.input, dev.ID(), tt.input)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright (c) 2018 Huawei Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+// Package uevent listens to the runtime host's own NETLINK_KOBJECT_UEVENT
+// multicast group and parses the datagrams it carries.
+//
+// The guest VM runs an independent kernel with its own uevent namespace:
+// nothing broadcasts a guest-internal event (eg a virtio-blk disk
+// becoming "vda" inside the guest) onto this host socket, and a guest's
+// own PCI slot addressing for a passed-through device is unrelated to the
+// device's host-side BDF. This package cannot observe what happens inside
+// the guest and is not a substitute for a real guest-side channel (eg the
+// agent RPC over vsock); it only sees uevents the host kernel itself
+// raises.
+package uevent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Event is a parsed NETLINK_KOBJECT_UEVENT message.
+type Event struct {
+	Action      string
+	Subsystem   string
+	DevPath     string
+	PCISlotName string
+	fields      map[string]string
+}
+
+// Field returns the raw value of a uevent field (eg "BUSNUM", "PRODUCT"),
+// or "" if it wasn't present.
+func (ev Event) Field(key string) string {
+	return ev.fields[key]
+}
+
+// NewEvent builds an Event from action, subsystem and the raw KEY=VALUE
+// fields a uevent carried. It's exported for subscribers that need to
+// construct Events in tests, mirroring what parseEvent does for events
+// read off the netlink socket.
+func NewEvent(action, subsystem string, fields map[string]string) Event {
+	return Event{
+		Action:      action,
+		Subsystem:   subsystem,
+		DevPath:     fields["DEVPATH"],
+		PCISlotName: fields["PCI_SLOT_NAME"],
+		fields:      fields,
+	}
+}
+
+// subscriber receives every event whose Subsystem matches, or every event
+// when subsystem is "".
+type subscriber struct {
+	subsystem string
+	ch        chan Event
+}
+
+// Watcher listens for uevents on the host's netlink bus, resolves them
+// into host-assigned device names keyed by PCI address for callers
+// blocked in WaitForDevice, and fans raw events out to any Subscribe
+// callers. See the package doc for what this can and can't observe.
+type Watcher struct {
+	fd int
+
+	mu      sync.Mutex
+	devices map[string]string        // pciAddress -> guestDevName
+	waiters map[string][]chan string // pciAddress -> channels awaiting a name
+	subs    []*subscriber
+}
+
+// NewWatcher opens a NETLINK_KOBJECT_UEVENT socket bound to the kernel
+// uevent multicast group and starts consuming events in the background.
+func NewWatcher() (*Watcher, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open uevent netlink socket: %v", err)
+	}
+
+	addr := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: 1,
+	}
+	if err := unix.Bind(fd, addr); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind uevent netlink socket: %v", err)
+	}
+
+	w := &Watcher{
+		fd:      fd,
+		devices: make(map[string]string),
+		waiters: make(map[string][]chan string),
+	}
+
+	go w.listen()
+
+	return w, nil
+}
+
+// Subscribe returns a channel that receives every subsequent event whose
+// Subsystem matches subsystem (eg "usb"), or every event if subsystem is
+// "". The returned cancel func unregisters the channel; callers must call
+// it once they stop reading to avoid leaking the subscription.
+func (w *Watcher) Subscribe(subsystem string) (<-chan Event, func()) {
+	sub := &subscriber{
+		subsystem: subsystem,
+		ch:        make(chan Event, 16),
+	}
+
+	w.mu.Lock()
+	w.subs = append(w.subs, sub)
+	w.mu.Unlock()
+
+	cancel := func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		for i, s := range w.subs {
+			if s == sub {
+				w.subs = append(w.subs[:i], w.subs[i+1:]...)
+				close(sub.ch)
+				return
+			}
+		}
+	}
+
+	return sub.ch, cancel
+}
+
+// publish fans ev out to every subscriber whose subsystem matches,
+// dropping the event for any subscriber whose channel is full rather than
+// blocking the listen loop.
+func (w *Watcher) publish(ev Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, sub := range w.subs {
+		if sub.subsystem != "" && sub.subsystem != ev.Subsystem {
+			continue
+		}
+
+		select {
+		case sub.ch <- ev:
+		default:
+		}
+	}
+}
+
+// Close releases the underlying netlink socket, unblocking any
+// in-progress reads.
+func (w *Watcher) Close() error {
+	return unix.Close(w.fd)
+}
+
+// WaitForDevice blocks until a device on pciAddr has appeared on the
+// host's netlink bus, returning the device name the host kernel assigned
+// it (eg "vda"), or until ctx is done. This never observes a name the
+// guest kernel assigned inside the VM; see the package doc.
+func (w *Watcher) WaitForDevice(ctx context.Context, pciAddr string) (string, error) {
+	w.mu.Lock()
+	if name, ok := w.devices[pciAddr]; ok {
+		w.mu.Unlock()
+		return name, nil
+	}
+
+	ch := make(chan string, 1)
+	w.waiters[pciAddr] = append(w.waiters[pciAddr], ch)
+	w.mu.Unlock()
+
+	select {
+	case name := <-ch:
+		return name, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// listen reads uevent datagrams until the socket is closed.
+func (w *Watcher) listen() {
+	buf := make([]byte, 64*1024)
+
+	for {
+		n, _, err := unix.Recvfrom(w.fd, buf, 0)
+		if err != nil {
+			return
+		}
+
+		ev := parseEvent(buf[:n])
+		if ev == nil {
+			continue
+		}
+
+		w.publish(*ev)
+		w.handleEvent(ev)
+	}
+}
+
+// handleEvent resolves an "add" event carrying a PCI_SLOT_NAME into the
+// host kernel's name for that device and wakes any waiter registered for
+// that address.
+func (w *Watcher) handleEvent(ev *Event) {
+	if ev.Action != "add" || ev.PCISlotName == "" {
+		return
+	}
+
+	guestName := guestDevName(ev)
+	if guestName == "" {
+		return
+	}
+
+	w.mu.Lock()
+	w.devices[ev.PCISlotName] = guestName
+	waiters := w.waiters[ev.PCISlotName]
+	delete(w.waiters, ev.PCISlotName)
+	w.mu.Unlock()
+
+	for _, ch := range waiters {
+		ch <- guestName
+	}
+}
+
+// guestDevName derives the host kernel's device name from DEVPATH, eg
+// ".../0000:00:05.0/virtio0/block/vda" -> "vda". Despite the name, this is
+// whatever the host kernel calls the device on the host's own bus, not
+// anything reported by the guest; see the package doc.
+func guestDevName(ev *Event) string {
+	if ev.DevPath == "" {
+		return ""
+	}
+	return filepath.Base(ev.DevPath)
+}
+
+// parseEvent parses a single NETLINK_KOBJECT_UEVENT datagram. The kernel
+// format is a header line ("add@/devices/...") followed by NUL-separated
+// KEY=VALUE fields.
+func parseEvent(msg []byte) *Event {
+	parts := bytes.Split(msg, []byte{0})
+	if len(parts) < 2 {
+		return nil
+	}
+
+	header := string(parts[0])
+	at := bytes.IndexByte(parts[0], '@')
+	if at < 0 {
+		return nil
+	}
+
+	ev := &Event{
+		Action: header[:at],
+		fields: make(map[string]string),
+	}
+
+	for _, part := range parts[1:] {
+		if len(part) == 0 {
+			continue
+		}
+
+		kv := bytes.SplitN(part, []byte{'='}, 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		ev.fields[string(kv[0])] = string(kv[1])
+	}
+
+	ev.Subsystem = ev.fields["SUBSYSTEM"]
+	ev.DevPath = ev.fields["DEVPATH"]
+	ev.PCISlotName = ev.fields["PCI_SLOT_NAME"]
+
+	return ev
+}